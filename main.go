@@ -2,18 +2,35 @@ package main
 
 import (
 	"container/heap"
-
+	"encoding/json"
+	"errors"
 	"fmt"
-
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"encoding/json"
-	"net/http"
-
 	"github.com/gofiber/fiber/v2"
 )
 
+// Errores de rechazo de una orden: los dos primeros los devuelve
+// addOrderInternal por las reglas de time-in-force, y el resto
+// InstrumentRegistry.Validate por las reglas del instrumento.
+// AddOrderHandler los traduce a una respuesta 422 con el motivo.
+var (
+	ErrFOKNotFillable   = errors.New("FOK order cannot be fully filled at the limit price")
+	ErrPostOnlyCross    = errors.New("POST_ONLY order would cross the opposite book")
+	ErrUnknownSymbol    = errors.New("unknown symbol")
+	ErrInvalidTickSize  = errors.New("price does not respect the instrument's tick size")
+	ErrInvalidLotSize   = errors.New("amount does not respect the instrument's lot size")
+	ErrBelowMinNotional = errors.New("order notional is below the instrument's minimum")
+)
+
 type OrderType string
 
 const (
@@ -21,13 +38,61 @@ const (
 	Sell OrderType = "SELL"
 )
 
+// TimeInForce indica cómo debe comportarse una orden frente al libro
+// en el momento en que se agrega.
+type TimeInForce string
+
+const (
+	// GTC (Good-Til-Cancelled) es una orden límite normal: si no se
+	// llena por completo, el remanente queda descansando en el heap.
+	GTC TimeInForce = "GTC"
+
+	// IOC (Immediate-Or-Cancel) intenta emparejar una sola vez contra
+	// el heap opuesto; cualquier remanente se descarta en vez de
+	// insertarse en el libro.
+	IOC TimeInForce = "IOC"
+
+	// FOK (Fill-Or-Kill) solo se ejecuta si el Amount completo puede
+	// llenarse de inmediato al precio límite; de lo contrario se
+	// rechaza sin ejecutar nada.
+	FOK TimeInForce = "FOK"
+
+	// POST_ONLY se rechaza si cruzaría el mejor precio opuesto actual;
+	// de lo contrario se inserta como maker.
+	PostOnly TimeInForce = "POST_ONLY"
+)
+
 // Order representa una orden en el libro
 type Order struct {
-	ID     int
-	Type   OrderType
-	Price  float64
-	Amount int
-	Index  int // Necesario para la estructura heap
+	ID          int
+	AccountID   string
+	Symbol      string
+	Type        OrderType
+	Price       float64
+	Amount      float64
+	TimeInForce TimeInForce
+
+	// Timestamp y Sequence se estampan en MatchingEngine.AddOrder, en
+	// ese orden, y los heaps los usan para desempatar órdenes al mismo
+	// precio por prioridad precio-tiempo (FIFO): la más antigua
+	// primero. Sequence existe porque Timestamp, en nanosegundos,
+	// igual puede repetirse entre dos órdenes que llegan en la misma
+	// ráfaga; al ser un contador monótono también vuelve los replays
+	// del ledger reproducibles.
+	Timestamp int64
+	Sequence  uint64
+
+	Index int // Necesario para la estructura heap
+}
+
+// orderBefore indica si a llegó antes que b (prioridad precio-tiempo),
+// comparando primero Timestamp y, si coinciden, Sequence. Lo usan
+// BuyHeap.Less y SellHeap.Less para desempatar órdenes al mismo precio.
+func orderBefore(a, b *Order) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.Sequence < b.Sequence
 }
 
 // ==========   Heap de compras  ========================
@@ -46,7 +111,12 @@ func (h BuyHeap) Len() int { return len(h) }
 // Less determina el orden de clasificación
 // en este caso, queremos un heap de máximos
 // por lo que la orden con el precio más alto estará en la parte superior
-func (h BuyHeap) Less(i, j int) bool { return h[i].Price > h[j].Price }
+func (h BuyHeap) Less(i, j int) bool {
+	if h[i].Price != h[j].Price {
+		return h[i].Price > h[j].Price
+	}
+	return orderBefore(h[i], h[j])
+}
 
 // Swap intercambia dos elementos en el heap
 // y actualiza los índices de los elementos
@@ -76,6 +146,17 @@ func (h *BuyHeap) Pop() interface{} {
 	return order
 }
 
+// PeekOrdered devuelve una copia de las órdenes del heap ordenadas por
+// prioridad de precio (de mayor a menor) sin extraerlas ni modificar el
+// heap subyacente. Lo usan las órdenes FOK para verificar si se puede
+// llenar el Amount completo antes de ejecutar nada.
+func (h BuyHeap) PeekOrdered() []*Order {
+	ordered := make([]*Order, len(h))
+	copy(ordered, h)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Price > ordered[j].Price })
+	return ordered
+}
+
 // heap de ventas
 type SellHeap []*Order
 
@@ -83,7 +164,12 @@ func (h SellHeap) Len() int { return len(h) }
 
 // En este caso, queremos un heap de mínimos
 // por lo que la orden con el precio más bajo estará en la parte superior
-func (h SellHeap) Less(i, j int) bool { return h[i].Price < h[j].Price }
+func (h SellHeap) Less(i, j int) bool {
+	if h[i].Price != h[j].Price {
+		return h[i].Price < h[j].Price
+	}
+	return orderBefore(h[i], h[j])
+}
 func (h SellHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
 	h[i].Index = i
@@ -105,279 +191,1715 @@ func (h *SellHeap) Pop() interface{} {
 	return order
 }
 
-// MatchingEngine es el motor de emparejamiento
-// que empareja las órdenes de compra y venta
-type MatchingEngine struct {
+// PeekOrdered devuelve una copia de las órdenes del heap ordenadas por
+// prioridad de precio (de menor a mayor) sin extraerlas ni modificar el
+// heap subyacente.
+func (h SellHeap) PeekOrdered() []*Order {
+	ordered := make([]*Order, len(h))
+	copy(ordered, h)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Price < ordered[j].Price })
+	return ordered
+}
+
+// InstrumentConfig describe las reglas de negociación de un símbolo:
+// el incremento mínimo de precio (TickSize), el incremento mínimo de
+// cantidad (LotSize) y el valor nocional mínimo (Precio * Amount) que
+// debe tener una orden para ser aceptada.
+type InstrumentConfig struct {
+	Symbol      string  `json:"symbol"`
+	TickSize    float64 `json:"tickSize"`
+	LotSize     float64 `json:"lotSize"`
+	MinNotional float64 `json:"minNotional"`
+}
+
+// InstrumentRegistry es el catálogo de instrumentos que el motor acepta
+// negociar. Se consulta antes de que una orden llegue a su Book para
+// rechazar, sin tocar ningún heap, las órdenes que violan las reglas
+// del símbolo.
+type InstrumentRegistry struct {
+	mu          sync.RWMutex
+	instruments map[string]InstrumentConfig
+}
+
+// NewInstrumentRegistry crea un registro a partir de una lista de
+// configuraciones de instrumento.
+func NewInstrumentRegistry(instruments []InstrumentConfig) *InstrumentRegistry {
+	r := &InstrumentRegistry{instruments: make(map[string]InstrumentConfig, len(instruments))}
+	for _, inst := range instruments {
+		r.instruments[inst.Symbol] = inst
+	}
+	return r
+}
+
+// defaultInstruments son las reglas usadas cuando no se encuentra un
+// archivo de configuración en disco; pensadas solo para desarrollo local.
+func defaultInstruments() []InstrumentConfig {
+	return []InstrumentConfig{
+		{Symbol: "BTCUSDT", TickSize: 0.01, LotSize: 0.0001, MinNotional: 10},
+		{Symbol: "ETHUSDT", TickSize: 0.01, LotSize: 0.001, MinNotional: 10},
+	}
+}
+
+// LoadInstrumentRegistry lee la configuración de instrumentos desde un
+// archivo JSON (un arreglo de InstrumentConfig). Si el archivo no
+// existe, cae de vuelta a defaultInstruments para que el motor siga
+// siendo utilizable en desarrollo local.
+func LoadInstrumentRegistry(path string) (*InstrumentRegistry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No se encontró %s, usando instrumentos por defecto\n", path)
+		return NewInstrumentRegistry(defaultInstruments()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var instruments []InstrumentConfig
+	if err := json.Unmarshal(data, &instruments); err != nil {
+		return nil, err
+	}
+	return NewInstrumentRegistry(instruments), nil
+}
+
+// Validate rechaza la orden si su símbolo no está registrado o si su
+// precio/cantidad no respetan el tick size, el lot size o el notional
+// mínimo del instrumento.
+func (r *InstrumentRegistry) Validate(order *Order) error {
+	r.mu.RLock()
+	inst, ok := r.instruments[order.Symbol]
+	r.mu.RUnlock()
+	if !ok {
+		return ErrUnknownSymbol
+	}
+
+	if !isMultipleOf(order.Price, inst.TickSize) {
+		return ErrInvalidTickSize
+	}
+	if !isMultipleOf(order.Amount, inst.LotSize) {
+		return ErrInvalidLotSize
+	}
+	if order.Price*order.Amount < inst.MinNotional {
+		return ErrBelowMinNotional
+	}
+	return nil
+}
+
+// isMultipleOf indica si value es un múltiplo entero de step, tolerando
+// el error de redondeo propio de la aritmética en punto flotante. Un
+// step <= 0 desactiva la restricción.
+func isMultipleOf(value, step float64) bool {
+	if step <= 0 {
+		return true
+	}
+	ratio := value / step
+	return math.Abs(ratio-math.Round(ratio)) < 1e-6
+}
+
+// Trade es el registro inmutable de una ejecución entre una orden de
+// compra y una de venta. Lo publica executeTrade en el tradeChannel del
+// libro; el TWAPManager lo consume para saber cuánto de un parent order
+// TWAP ya se llenó.
+type Trade struct {
+	BuyOrderID  int
+	SellOrderID int
+	Symbol      string
+	Price       float64
+	Amount      float64
+	Ts          time.Time
+}
+
+// Position es la posición abierta de una cuenta en un símbolo: cuánto
+// activo base y quote mantiene, y a qué costo promedio se compró el
+// base que sigue abierto.
+type Position struct {
+	AccountID   string
+	Symbol      string
+	Base        float64
+	Quote       float64
+	AverageCost float64
+}
+
+// ProfitStats acumula el desempeño de una cuenta en un símbolo.
+// Unrealized no se actualiza automáticamente: no hay un feed de precios
+// en este motor, así que queda en manos de quien consulte el ledger
+// recalcularlo con el último precio de mercado que conozca.
+type ProfitStats struct {
+	AccountID  string
+	Symbol     string
+	Realized   float64
+	Unrealized float64
+	Volume     float64
+}
+
+// Store es el backend de persistencia del ledger: dónde se guardan los
+// trades, las posiciones y las órdenes abiertas para que el motor
+// pueda rehidratarse tras un reinicio sin perder estado.
+type Store interface {
+	AppendTrade(trade Trade) error
+	SavePosition(pos Position) error
+	SaveOrder(order *Order) error
+	RemoveOrder(symbol string, orderID int) error
+	LoadOpenOrders() ([]*Order, error)
+	LoadPositions() ([]Position, error)
+}
+
+// JSONFileStore es el backend de persistencia por defecto: guarda los
+// trades en un archivo JSON Lines (uno por línea, solo apéndice) y las
+// órdenes abiertas y las posiciones en sendos archivos JSON que se
+// reescriben por completo en cada cambio. Pensado para una sola
+// instancia del motor; no es apto para acceso concurrente entre
+// procesos.
+type JSONFileStore struct {
+	mu sync.Mutex
+
+	tradesPath    string
+	ordersPath    string
+	positionsPath string
+}
+
+// NewJSONFileStore crea un JSONFileStore cuyos tres archivos viven bajo
+// dir (que debe existir). Si dir está vacío usa el directorio actual.
+func NewJSONFileStore(dir string) *JSONFileStore {
+	return &JSONFileStore{
+		tradesPath:    filepath.Join(dir, "trades.jsonl"),
+		ordersPath:    filepath.Join(dir, "orders.json"),
+		positionsPath: filepath.Join(dir, "positions.json"),
+	}
+}
+
+// AppendTrade agrega trade como una línea más de tradesPath.
+func (s *JSONFileStore) AppendTrade(trade Trade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.tradesPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// SaveOrder agrega o actualiza order dentro de ordersPath.
+func (s *JSONFileStore) SaveOrder(order *Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders, err := s.readOrdersLocked()
+	if err != nil {
+		return err
+	}
+	orders[order.ID] = order
+	return s.writeOrdersLocked(orders)
+}
+
+// RemoveOrder quita la orden orderID de ordersPath. symbol no hace
+// falta para ubicarla (el ID ya es único) pero forma parte de la
+// interfaz para que un backend con particionado por símbolo pueda
+// usarlo para construir la clave. RedisStore tampoco lo usa: sus
+// claves de orden son solo por ID.
+func (s *JSONFileStore) RemoveOrder(symbol string, orderID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders, err := s.readOrdersLocked()
+	if err != nil {
+		return err
+	}
+	delete(orders, orderID)
+	return s.writeOrdersLocked(orders)
+}
+
+// LoadOpenOrders devuelve todas las órdenes guardadas en ordersPath.
+func (s *JSONFileStore) LoadOpenOrders() ([]*Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orders, err := s.readOrdersLocked()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*Order, 0, len(orders))
+	for _, order := range orders {
+		result = append(result, order)
+	}
+	return result, nil
+}
+
+func (s *JSONFileStore) readOrdersLocked() (map[int]*Order, error) {
+	data, err := os.ReadFile(s.ordersPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[int]*Order), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	orders := make(map[int]*Order)
+	if err := json.Unmarshal(data, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (s *JSONFileStore) writeOrdersLocked(orders map[int]*Order) error {
+	data, err := json.Marshal(orders)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.ordersPath, data, 0644)
+}
+
+// SavePosition agrega o actualiza la posición de pos.AccountID en
+// pos.Symbol dentro de positionsPath.
+func (s *JSONFileStore) SavePosition(pos Position) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	positions, err := s.readPositionsLocked()
+	if err != nil {
+		return err
+	}
+	positions[pos.AccountID+"|"+pos.Symbol] = pos
+	return s.writePositionsLocked(positions)
+}
+
+// LoadPositions devuelve todas las posiciones guardadas en positionsPath.
+func (s *JSONFileStore) LoadPositions() ([]Position, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	positions, err := s.readPositionsLocked()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Position, 0, len(positions))
+	for _, pos := range positions {
+		result = append(result, pos)
+	}
+	return result, nil
+}
+
+func (s *JSONFileStore) readPositionsLocked() (map[string]Position, error) {
+	data, err := os.ReadFile(s.positionsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]Position), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	positions := make(map[string]Position)
+	if err := json.Unmarshal(data, &positions); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+func (s *JSONFileStore) writePositionsLocked(positions map[string]Position) error {
+	data, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.positionsPath, data, 0644)
+}
+
+// RedisClient es el subconjunto de comandos de Redis que RedisStore
+// necesita. Se define como interfaz, en vez de importar un cliente de
+// Redis concreto, para no atar este motor a una librería específica;
+// quien quiera el backend de Redis en producción inyecta su propio
+// cliente (p.ej. go-redis) que la satisfaga.
+type RedisClient interface {
+	Set(key string, value []byte) error
+	Get(key string) ([]byte, error)
+	Keys(pattern string) ([]string, error)
+	RPush(key string, value []byte) error
+}
+
+// RedisStore es el backend de persistencia usado en el ecosistema
+// externo para correr varias instancias del motor contra el mismo
+// estado. Guarda cada orden y cada posición bajo su propia clave y
+// apila los trades en una lista.
+type RedisStore struct {
+	client RedisClient
+}
+
+// NewRedisStore crea un RedisStore respaldado por client.
+func NewRedisStore(client RedisClient) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func (s *RedisStore) AppendTrade(trade Trade) error {
+	data, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+	return s.client.RPush("trades", data)
+}
+
+func (s *RedisStore) SaveOrder(order *Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(fmt.Sprintf("order:%d", order.ID), data)
+}
+
+func (s *RedisStore) RemoveOrder(symbol string, orderID int) error {
+	return s.client.Set(fmt.Sprintf("order:%d", orderID), nil)
+}
+
+func (s *RedisStore) LoadOpenOrders() ([]*Order, error) {
+	keys, err := s.client.Keys("order:*")
+	if err != nil {
+		return nil, err
+	}
+
+	orders := make([]*Order, 0, len(keys))
+	for _, key := range keys {
+		data, err := s.client.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			// Tombstone dejado por RemoveOrder.
+			continue
+		}
+		order := new(Order)
+		if err := json.Unmarshal(data, order); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func (s *RedisStore) SavePosition(pos Position) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(fmt.Sprintf("position:%s:%s", pos.AccountID, pos.Symbol), data)
+}
+
+func (s *RedisStore) LoadPositions() ([]Position, error) {
+	keys, err := s.client.Keys("position:*")
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make([]Position, 0, len(keys))
+	for _, key := range keys {
+		data, err := s.client.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		var pos Position
+		if err := json.Unmarshal(data, &pos); err != nil {
+			return nil, err
+		}
+		positions = append(positions, pos)
+	}
+	return positions, nil
+}
+
+// BatchedStore envuelve otro Store y acumula los trades en memoria,
+// descargándolos a inner cada flushEvery en vez de escribirlos uno por
+// uno. Las órdenes y posiciones se delegan a inner de forma síncrona,
+// porque Replay necesita verlas de inmediato tras cada reinicio.
+type BatchedStore struct {
+	inner      Store
+	flushEvery time.Duration
+
+	mu      sync.Mutex
+	pending []Trade
+
+	stop chan struct{}
+}
+
+// NewBatchedStore crea un BatchedStore que descarga los trades
+// pendientes sobre inner cada flushEvery.
+func NewBatchedStore(inner Store, flushEvery time.Duration) *BatchedStore {
+	s := &BatchedStore{
+		inner:      inner,
+		flushEvery: flushEvery,
+		stop:       make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *BatchedStore) loop() {
+	ticker := time.NewTicker(s.flushEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *BatchedStore) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	for _, trade := range pending {
+		if err := s.inner.AppendTrade(trade); err != nil {
+			fmt.Printf("BatchedStore: error al volcar trade %d/%d: %s\n", trade.BuyOrderID, trade.SellOrderID, err)
+		}
+	}
+}
+
+// Stop descarga cualquier trade pendiente y detiene el timer de flush.
+func (s *BatchedStore) Stop() {
+	close(s.stop)
+}
+
+func (s *BatchedStore) AppendTrade(trade Trade) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, trade)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *BatchedStore) SaveOrder(order *Order) error { return s.inner.SaveOrder(order) }
+func (s *BatchedStore) RemoveOrder(symbol string, id int) error {
+	return s.inner.RemoveOrder(symbol, id)
+}
+func (s *BatchedStore) SavePosition(pos Position) error    { return s.inner.SavePosition(pos) }
+func (s *BatchedStore) LoadOpenOrders() ([]*Order, error)  { return s.inner.LoadOpenOrders() }
+func (s *BatchedStore) LoadPositions() ([]Position, error) { return s.inner.LoadPositions() }
+
+// Ledger lleva, para cada cuenta, su Position y sus ProfitStats por
+// símbolo, y persiste cada trade y cada cambio de posición en un
+// Store. Book.executeTrade llama a RecordTrade en cada match.
+type Ledger struct {
+	store Store
+
+	mu          sync.Mutex
+	positions   map[string]map[string]*Position
+	stats       map[string]map[string]*ProfitStats
+	tradesByAcc map[string][]Trade
+}
+
+// NewLedger crea un Ledger respaldado por store. store puede ser nil,
+// en cuyo caso el ledger sigue llevando la cuenta en memoria pero no
+// persiste nada (útil en tests).
+func NewLedger(store Store) *Ledger {
+	return &Ledger{
+		store:       store,
+		positions:   make(map[string]map[string]*Position),
+		stats:       make(map[string]map[string]*ProfitStats),
+		tradesByAcc: make(map[string][]Trade),
+	}
+}
+
+// RecordTrade actualiza la posición y las estadísticas de P&L del
+// comprador y del vendedor, y persiste el trade (y las posiciones
+// resultantes) en el Store configurado.
+func (l *Ledger) RecordTrade(trade Trade, buyOrder, sellOrder *Order) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.store != nil {
+		if err := l.store.AppendTrade(trade); err != nil {
+			fmt.Printf("Ledger: error al persistir trade %d/%d: %s\n", trade.BuyOrderID, trade.SellOrderID, err)
+		}
+	}
+
+	if buyOrder.AccountID != "" {
+		l.applyFill(buyOrder.AccountID, trade.Symbol, Buy, trade.Amount, trade.Price)
+		l.tradesByAcc[buyOrder.AccountID] = append(l.tradesByAcc[buyOrder.AccountID], trade)
+	}
+	if sellOrder.AccountID != "" {
+		l.applyFill(sellOrder.AccountID, trade.Symbol, Sell, trade.Amount, trade.Price)
+		l.tradesByAcc[sellOrder.AccountID] = append(l.tradesByAcc[sellOrder.AccountID], trade)
+	}
+}
+
+// applyFill actualiza la Position y el ProfitStats de accountID en
+// symbol con un fill de amount unidades a price, y persiste la
+// posición resultante.
+func (l *Ledger) applyFill(accountID, symbol string, side OrderType, amount float64, price float64) {
+	pos := l.positionLocked(accountID, symbol)
+	stats := l.statsLocked(accountID, symbol)
+
+	qty := amount
+	notional := qty * price
+	stats.Volume += notional
+
+	if side == Buy {
+		newBase := pos.Base + qty
+		if newBase > 0 {
+			pos.AverageCost = (pos.AverageCost*pos.Base + notional) / newBase
+		}
+		pos.Base = newBase
+		pos.Quote -= notional
+	} else {
+		stats.Realized += (price - pos.AverageCost) * qty
+		pos.Base -= qty
+		pos.Quote += notional
+	}
+
+	if l.store != nil {
+		if err := l.store.SavePosition(*pos); err != nil {
+			fmt.Printf("Ledger: error al persistir posición %s/%s: %s\n", accountID, symbol, err)
+		}
+	}
+}
+
+// positionLocked devuelve (creándola si hace falta) la Position de
+// accountID en symbol. El llamador debe tener l.mu tomado.
+func (l *Ledger) positionLocked(accountID, symbol string) *Position {
+	bySymbol, ok := l.positions[accountID]
+	if !ok {
+		bySymbol = make(map[string]*Position)
+		l.positions[accountID] = bySymbol
+	}
+	pos, ok := bySymbol[symbol]
+	if !ok {
+		pos = &Position{AccountID: accountID, Symbol: symbol}
+		bySymbol[symbol] = pos
+	}
+	return pos
+}
+
+// statsLocked devuelve (creándolas si hace falta) las ProfitStats de
+// accountID en symbol. El llamador debe tener l.mu tomado.
+func (l *Ledger) statsLocked(accountID, symbol string) *ProfitStats {
+	bySymbol, ok := l.stats[accountID]
+	if !ok {
+		bySymbol = make(map[string]*ProfitStats)
+		l.stats[accountID] = bySymbol
+	}
+	stats, ok := bySymbol[symbol]
+	if !ok {
+		stats = &ProfitStats{AccountID: accountID, Symbol: symbol}
+		bySymbol[symbol] = stats
+	}
+	return stats
+}
+
+// GetPosition devuelve la posición de accountID en symbol, y false si
+// la cuenta nunca operó ese símbolo.
+func (l *Ledger) GetPosition(accountID, symbol string) (Position, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bySymbol, ok := l.positions[accountID]
+	if !ok {
+		return Position{}, false
+	}
+	pos, ok := bySymbol[symbol]
+	if !ok {
+		return Position{}, false
+	}
+	return *pos, true
+}
+
+// GetTrades devuelve, en orden de ejecución, todos los trades en los
+// que accountID participó como comprador o vendedor.
+func (l *Ledger) GetTrades(accountID string) []Trade {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	trades := make([]Trade, len(l.tradesByAcc[accountID]))
+	copy(trades, l.tradesByAcc[accountID])
+	return trades
+}
+
+// restorePosition carga una Position leída del Store directamente en
+// memoria, sin volver a persistirla. Lo usa MatchingEngine.Replay al
+// rehidratar el estado tras un reinicio.
+func (l *Ledger) restorePosition(pos Position) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	restored := pos
+	l.positionLocked(pos.AccountID, pos.Symbol)
+	l.positions[pos.AccountID][pos.Symbol] = &restored
+}
+
+// orderRequest empareja una orden entrante con el canal por el que
+// processOrders devuelve el resultado de aplicar sus reglas de
+// time-in-force.
+type orderRequest struct {
+	order  *Order
+	result chan error
+}
+
+// Book es el libro de órdenes de un único símbolo: sus propios heaps de
+// compra y venta, su propio mutex y su propio canal de órdenes. El
+// motor mantiene un Book por símbolo para que los mercados no compitan
+// entre sí por un único heap global.
+type Book struct {
+	Symbol string
+
 	// BuyOrders y SellOrders son heaps de órdenes
 	BuyOrders  *BuyHeap
 	SellOrders *SellHeap
 
-	// Mutexes para proteger los heaps
-	// de acceso concurrente
-	/*
-		(mutual exclusion) que garantizará que nuestro
-		código no acceda a una variable hasta que
-		nosotros le indiquemos, evitando que se den
-		las condiciones de carrera o race conditions.
-	*/
-	buyMutex  sync.Mutex
-	sellMutex sync.Mutex
+	// mu protege tanto BuyOrders como SellOrders. Antes eran dos
+	// mutexes separados, pero MatchOrders siempre necesita ambos
+	// heaps a la vez: con dos locks, el patrón pop-comparar-(si no
+	// hay match)-devolver soltaba y volvía a tomar cada mutex entre
+	// medio, dejando una ventana donde otra orden podía colarse entre
+	// el pop y el push-back. Un solo mutex cubre toda esa sección
+	// crítica de una vez.
+	mu sync.Mutex
 
 	// orderChannel es un canal para enviar órdenes
-	// al motor de emparejamiento
-	orderChannel chan *Order
+	// a este libro. Cada envío va acompañado de un canal
+	// de respuesta porque las órdenes IOC/FOK/POST_ONLY necesitan
+	// informar de inmediato si fueron rechazadas.
+	orderChannel chan *orderRequest
+
+	// matchTrigger despierta a StartMatching cuando processOrders
+	// agrega una orden que podría cruzar el libro opuesto. Tiene
+	// buffer 1: si ya hay un disparo pendiente, uno nuevo no aporta
+	// nada (MatchOrders siempre agota todos los cruces posibles en una
+	// corrida), así que se descarta con un envío no bloqueante.
+	matchTrigger chan struct{}
+
+	// tradeChannel es donde este libro publica cada Trade que ejecuta.
+	// Puede ser nil (por ejemplo en tests) si a nadie le interesa
+	// escuchar los trades del libro.
+	tradeChannel chan<- Trade
+
+	// ledger recibe cada Trade ejecutado para actualizar posiciones y
+	// P&L por cuenta. Puede ser nil si no hay ledger configurado.
+	ledger *Ledger
+
+	// store persiste las órdenes que quedan descansando en el heap y
+	// las que se llenan o se eliminan, para poder rehidratar el libro
+	// tras un reinicio. Puede ser nil (sin persistencia).
+	store Store
 }
 
-// NewMatchingEngine crea un nuevo MatchingEngine
-// y comienza a procesar las órdenes
-// en un gorutina separada
-func NewMatchingEngine() *MatchingEngine {
-
-	// Crear un nuevo MatchingEngine
-	// con heaps de compras y ventas
-	me := &MatchingEngine{
-		BuyOrders:  &BuyHeap{},
-		SellOrders: &SellHeap{},
-
-		// Inicializar el canal de órdenes
-		// para enviar órdenes al motor de emparejamiento
-		// desde otras gorutinas
-		orderChannel: make(chan *Order),
+// NewBook crea un Book vacío para symbol y comienza a procesar sus
+// órdenes en una gorutina separada. tradeChannel recibe una copia de
+// cada Trade que el libro ejecuta; ledger y store pueden ser nil si no
+// hace falta llevar P&L ni persistir el estado del libro.
+func NewBook(symbol string, tradeChannel chan<- Trade, ledger *Ledger, store Store) *Book {
+	b := &Book{
+		Symbol:       symbol,
+		BuyOrders:    &BuyHeap{},
+		SellOrders:   &SellHeap{},
+		orderChannel: make(chan *orderRequest),
+		matchTrigger: make(chan struct{}, 1),
+		tradeChannel: tradeChannel,
+		ledger:       ledger,
+		store:        store,
 	}
 
-	// Comenzar a procesar las órdenes
-	// en un gorutina separada
-	go me.processOrders()
+	go b.processOrders()
+	b.StartMatching()
+
+	return b
+}
 
-	return me
+// restoreOrder inserta order directamente en el heap que le
+// corresponde, sin pasar por el canal ni por las reglas de
+// time-in-force ni por el store (ya está persistido). Lo usa
+// MatchingEngine.Replay al rehidratar el libro tras un reinicio.
+func (b *Book) restoreOrder(order *Order) {
+	b.mu.Lock()
+	if order.Type == Buy {
+		heap.Push(b.BuyOrders, order)
+	} else {
+		heap.Push(b.SellOrders, order)
+	}
+	b.mu.Unlock()
+	b.trigger()
 }
 
 // processOrders es un bucle infinito que procesa
-// las órdenes enviadas al motor de emparejamiento
+// las órdenes enviadas a este libro
 // a través del canal orderChannel
-func (me *MatchingEngine) processOrders() {
+func (b *Book) processOrders() {
 
 	// Recorrer todas las órdenes enviadas al canal
-	for order := range me.orderChannel {
-
-		// Agregar la orden al heap correspondiente
-		me.addOrderInternal(order)
+	for req := range b.orderChannel {
+		order := req.order
+
+		// Solo las GTC (y cualquier TimeInForce no reconocido, que
+		// addOrderInternal trata como GTC) entran al heap tal cual y
+		// dependen de StartMatching para cruzar (IOC y FOK ya se
+		// emparejan síncronamente dentro de addOrderInternal, y
+		// POST_ONLY se rechaza si cruza). Por eso basta con mirar el
+		// libro opuesto antes de agregarla cuando no es IOC, FOK ni
+		// POST_ONLY.
+		mightCross := order.TimeInForce != IOC && order.TimeInForce != FOK &&
+			order.TimeInForce != PostOnly && b.crossesOppositeBook(order)
+
+		// Agregar la orden al heap correspondiente, aplicando sus
+		// reglas de time-in-force, y devolver el resultado a quien
+		// la envió
+		err := b.addOrderInternal(order)
+		req.result <- err
+
+		if err == nil && mightCross {
+			b.trigger()
+		}
+	}
+}
 
-		// Intentar emparejar las órdenes
-		//me.MatchOrders()
+// trigger despierta a StartMatching de forma no bloqueante. Si ya hay
+// un disparo pendiente en el buffer, este se descarta sin más: basta
+// con que MatchOrders corra una vez más para agotar todos los cruces
+// posibles, así que acumular disparos no aporta nada.
+func (b *Book) trigger() {
+	select {
+	case b.matchTrigger <- struct{}{}:
+	default:
 	}
 }
 
-// AddOrder agrega una orden al canal de órdenes
-// para que sea procesada por el motor de emparejamiento
-func (me *MatchingEngine) AddOrder(order *Order) {
-	me.orderChannel <- order
+// AddOrder envía una orden a este libro y espera a que se
+// apliquen sus reglas de time-in-force. Devuelve un error no nil cuando
+// la orden fue rechazada (FOK que no se puede llenar por completo,
+// POST_ONLY que cruzaría el libro opuesto).
+func (b *Book) AddOrder(order *Order) error {
+	req := &orderRequest{order: order, result: make(chan error, 1)}
+	b.orderChannel <- req
+	return <-req.result
 }
 
-// addOrderInternal agrega una orden al heap correspondiente
-// y actualiza el heap
-func (me *MatchingEngine) addOrderInternal(order *Order) {
+// addOrderInternal aplica las reglas de time-in-force de la orden:
+//   - GTC se agrega al heap tal cual, como hasta ahora.
+//   - IOC intenta emparejar una sola vez contra el heap opuesto y
+//     descarta el remanente en vez de insertarlo.
+//   - FOK verifica, sin mutar el heap opuesto, que el Amount completo
+//     se puede llenar al precio límite antes de ejecutar nada; si no,
+//     se rechaza de forma atómica.
+//   - POST_ONLY se rechaza si cruzaría el mejor precio opuesto actual;
+//     de lo contrario se agrega como maker, igual que GTC.
+func (b *Book) addOrderInternal(order *Order) error {
+
+	switch order.TimeInForce {
+	case FOK:
+		// Verificar y ejecutar bajo el mismo Lock: si se soltara entre
+		// medio, una MatchOrders concurrente podría consumir la
+		// liquidez que acabamos de confirmar, y el remanente se
+		// descartaría en silencio — justo lo que FOK promete evitar.
+		b.mu.Lock()
+		if !b.canFillCompletelyLocked(order) {
+			b.mu.Unlock()
+			return ErrFOKNotFillable
+		}
+		b.matchImmediatelyLocked(order)
+		b.mu.Unlock()
+		return nil
+
+	case IOC:
+		b.matchImmediately(order)
+		// El remanente, si lo hay, se descarta: no se inserta en el heap.
+		return nil
+
+	case PostOnly:
+		// Verificar y empujar bajo el mismo Lock: si se soltara entre
+		// medio, una orden cruzada podría colarse en el heap opuesto
+		// justo después de la verificación, y el POST_ONLY terminaría
+		// descansando como maker cruzado — justo lo que el flag
+		// promete evitar.
+		b.mu.Lock()
+		if b.crossesOppositeBookLocked(order) {
+			b.mu.Unlock()
+			return ErrPostOnlyCross
+		}
+		if order.Type == Buy {
+			heap.Push(b.BuyOrders, order)
+		} else {
+			heap.Push(b.SellOrders, order)
+		}
+		b.mu.Unlock()
 
-	if order.Type == Buy {
-		// Proteger el heap de compras
-		me.buyMutex.Lock()
+		b.persistRestingOrder(order)
 
-		// Agregar la orden al heap de compras
-		heap.Push(me.BuyOrders, order)
+		return nil
+	}
 
-		// Desbloquear el heap de compras
-		me.buyMutex.Unlock()
+	b.mu.Lock()
+	if order.Type == Buy {
+		heap.Push(b.BuyOrders, order)
 	} else {
-		me.sellMutex.Lock()
-		heap.Push(me.SellOrders, order)
-		me.sellMutex.Unlock()
+		heap.Push(b.SellOrders, order)
 	}
+	b.mu.Unlock()
+
+	b.persistRestingOrder(order)
+
+	return nil
 }
 
-func (me *MatchingEngine) MatchOrders() {
-	startTime := time.Now()
-	matchesFound := 0
-	iterationCount := 0
+// persistRestingOrder guarda order en el store configurado, si lo hay.
+func (b *Book) persistRestingOrder(order *Order) {
+	if b.store == nil {
+		return
+	}
+	if err := b.store.SaveOrder(order); err != nil {
+		fmt.Printf("Store: error al persistir la orden %d: %s\n", order.ID, err)
+	}
+}
 
-	fmt.Printf("\n=== INICIO DEL MATCHING ===\n")
-	fmt.Printf("Estado inicial: %d compras, %d ventas\n", me.BuyOrders.Len(), me.SellOrders.Len())
-	fmt.Printf("Tiempo de inicio: %s\n", startTime)
+// persistOrderRemoved elimina order del store configurado, si lo hay.
+func (b *Book) persistOrderRemoved(order *Order) {
+	if b.store == nil {
+		return
+	}
+	if err := b.store.RemoveOrder(b.Symbol, order.ID); err != nil {
+		fmt.Printf("Store: error al eliminar la orden %d: %s\n", order.ID, err)
+	}
+}
 
-	for {
-		iterationCount++
-		fmt.Printf("\n--- Iteración %d ---\n", iterationCount)
+// crossesOppositeBook indica si order, de insertarse ahora mismo,
+// cruzaría el mejor precio del heap opuesto.
+func (b *Book) crossesOppositeBook(order *Order) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.crossesOppositeBookLocked(order)
+}
 
-		// Obtener la mejor orden de compra
-		me.buyMutex.Lock()
-		if me.BuyOrders.Len() == 0 {
-			fmt.Printf("No hay órdenes de compra disponibles\n")
-			me.buyMutex.Unlock()
-			break
+// crossesOppositeBookLocked es como crossesOppositeBook pero asume que
+// quien la llama ya tiene b.mu tomado. Lo usa el caso POST_ONLY de
+// addOrderInternal, que necesita verificar y empujar en una sola
+// sección crítica.
+func (b *Book) crossesOppositeBookLocked(order *Order) bool {
+	if order.Type == Buy {
+		best := b.getHighestSellOrderLocked()
+		return best != nil && order.Price >= best.Price
+	}
+	best := b.getHighestBuyOrderLocked()
+	return best != nil && order.Price <= best.Price
+}
+
+// canFillCompletely recorre el heap opuesto en orden de precio, sin
+// extraer ni modificar ninguna orden, y determina si la suma de
+// Amount de las órdenes que cruzan alcanza para llenar order.Amount
+// por completo.
+func (b *Book) canFillCompletely(order *Order) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.canFillCompletelyLocked(order)
+}
+
+// canFillCompletelyLocked es como canFillCompletely pero asume que
+// quien la llama ya tiene b.mu tomado. Lo usa el caso FOK de
+// addOrderInternal, que necesita verificar y ejecutar en una sola
+// sección crítica.
+func (b *Book) canFillCompletelyLocked(order *Order) bool {
+	remaining := order.Amount
+
+	if order.Type == Buy {
+		for _, sell := range b.SellOrders.PeekOrdered() {
+			if sell.Price > order.Price {
+				break
+			}
+			remaining -= sell.Amount
+			if remaining <= 0 {
+				return true
+			}
 		}
-		buyLen := me.BuyOrders.Len()
-		bestBuy := heap.Pop(me.BuyOrders).(*Order)
-		fmt.Printf("Compras antes/después del Pop: %d/%d\n", buyLen, me.BuyOrders.Len())
-		me.buyMutex.Unlock()
-
-		// Obtener la mejor orden de venta
-		me.sellMutex.Lock()
-		if me.SellOrders.Len() == 0 {
-			fmt.Printf("No hay órdenes de venta disponibles, devolviendo compra al heap\n")
-			me.sellMutex.Unlock()
-			me.buyMutex.Lock()
-			prevLen := me.BuyOrders.Len()
-			heap.Push(me.BuyOrders, bestBuy)
-			fmt.Printf("Compras antes/después del Push: %d/%d\n", prevLen, me.BuyOrders.Len())
-			me.buyMutex.Unlock()
+		return false
+	}
+
+	for _, buy := range b.BuyOrders.PeekOrdered() {
+		if buy.Price < order.Price {
 			break
 		}
-		sellLen := me.SellOrders.Len()
-		bestSell := heap.Pop(me.SellOrders).(*Order)
-		fmt.Printf("Ventas antes/después del Pop: %d/%d\n", sellLen, me.SellOrders.Len())
-		me.sellMutex.Unlock()
+		remaining -= buy.Amount
+		if remaining <= 0 {
+			return true
+		}
+	}
+	return false
+}
 
-		fmt.Printf("Comparando: Compra ID=%d Precio=%.2f Cantidad=%d vs Venta ID=%d Precio=%.2f Cantidad=%d\n",
-			bestBuy.ID, bestBuy.Price, bestBuy.Amount, bestSell.ID, bestSell.Price, bestSell.Amount)
+// matchImmediately empareja order contra el heap opuesto una sola
+// pasada, ejecutando trades mientras los precios crucen y queden
+// órdenes opuestas disponibles. A diferencia de MatchOrders, nunca
+// reinserta order: lo usa IOC, que descarta el remanente sin
+// necesitar ninguna garantía de atomicidad frente a MatchOrders.
+func (b *Book) matchImmediately(order *Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.matchImmediatelyLocked(order)
+}
 
-		// Verificar si los precios coinciden
-		if bestBuy.Price >= bestSell.Price {
-			tradeAmount := min(bestBuy.Amount, bestSell.Amount)
-			matchesFound++
+// matchImmediatelyLocked es como matchImmediately pero asume que quien
+// la llama ya tiene b.mu tomado durante toda la pasada. Lo usa el caso
+// FOK de addOrderInternal: como ya verificó con canFillCompletelyLocked
+// que el Amount completo se puede llenar, necesita ejecutar sin soltar
+// el lock en ningún momento, o una MatchOrders concurrente podría
+// consumir la liquidez verificada antes de que FOK termine de tomarla.
+func (b *Book) matchImmediatelyLocked(order *Order) {
+	for order.Amount > 0 {
+		if order.Type == Buy {
+			if b.SellOrders.Len() == 0 {
+				return
+			}
+			best := (*b.SellOrders)[0]
+			if order.Price < best.Price {
+				return
+			}
+			bestSell := heap.Pop(b.SellOrders).(*Order)
 
-			fmt.Printf("\nMATCH #%d: Compra %d @ %.2f vs Venta %d @ %.2f, Cantidad=%d\n",
-				matchesFound, bestBuy.ID, bestBuy.Price, bestSell.ID, bestSell.Price, tradeAmount)
+			tradeAmount := min(order.Amount, bestSell.Amount)
+			b.executeTrade(order, bestSell, tradeAmount, 0)
+			order.Amount -= tradeAmount
+			bestSell.Amount -= tradeAmount
 
-			fmt.Printf("Cantidades antes del trade - Compra: %d, Venta: %d\n",
-				bestBuy.Amount, bestSell.Amount)
+			if bestSell.Amount > 0 {
+				heap.Push(b.SellOrders, bestSell)
+				b.persistRestingOrder(bestSell)
+			} else {
+				b.persistOrderRemoved(bestSell)
+			}
+		} else {
+			if b.BuyOrders.Len() == 0 {
+				return
+			}
+			best := (*b.BuyOrders)[0]
+			if order.Price > best.Price {
+				return
+			}
+			bestBuy := heap.Pop(b.BuyOrders).(*Order)
 
-			// Actualizar cantidades
+			tradeAmount := min(order.Amount, bestBuy.Amount)
+			b.executeTrade(bestBuy, order, tradeAmount, 0)
+			order.Amount -= tradeAmount
 			bestBuy.Amount -= tradeAmount
-			bestSell.Amount -= tradeAmount
 
-			fmt.Printf("Cantidades después del trade - Compra: %d, Venta: %d\n",
-				bestBuy.Amount, bestSell.Amount)
-
-			// Solo reinsertar órdenes si tienen cantidad restante
 			if bestBuy.Amount > 0 {
-				me.buyMutex.Lock()
-				prevLen := me.BuyOrders.Len()
-				heap.Push(me.BuyOrders, bestBuy)
-				fmt.Printf("Reinsertando compra %d - Heap antes/después: %d/%d\n",
-					bestBuy.ID, prevLen, me.BuyOrders.Len())
-				me.buyMutex.Unlock()
+				heap.Push(b.BuyOrders, bestBuy)
+				b.persistRestingOrder(bestBuy)
 			} else {
-				fmt.Printf("Orden de compra %d completada y eliminada\n", bestBuy.ID)
+				b.persistOrderRemoved(bestBuy)
 			}
+		}
+	}
+}
 
-			if bestSell.Amount > 0 {
-				me.sellMutex.Lock()
-				prevLen := me.SellOrders.Len()
-				heap.Push(me.SellOrders, bestSell)
-				fmt.Printf("Reinsertando venta %d - Heap antes/después: %d/%d\n",
-					bestSell.ID, prevLen, me.SellOrders.Len())
-				me.sellMutex.Unlock()
-			} else {
-				fmt.Printf("Orden de venta %d completada y eliminada\n", bestSell.ID)
-			}
-		} else {
-			fmt.Printf("\nNo hay match: Precio compra %.2f < Precio venta %.2f\n",
-				bestBuy.Price, bestSell.Price)
+// debugMatching activa los logs de diagnóstico de MatchOrders y
+// executeTrade: por defecto están apagados porque se emiten por
+// iteración y por trade, y a 100k órdenes/segundo esas escrituras a
+// stdout son justo el costo de CPU que el camino event-driven existe
+// para evitar (y sesgarían matching_bench_test.go). Se activan
+// fijando la variable de entorno MATCH_ENGINE_DEBUG antes de arrancar.
+var debugMatching = os.Getenv("MATCH_ENGINE_DEBUG") != ""
+
+// debugf es como fmt.Printf pero solo escribe si debugMatching está
+// activo.
+func debugf(format string, args ...interface{}) {
+	if debugMatching {
+		fmt.Printf(format, args...)
+	}
+}
+
+func (b *Book) MatchOrders() {
+	startTime := time.Now()
+	matchesFound := 0
+	iterationCount := 0
+
+	startBuys, startSells := b.lens()
+	debugf("\n=== INICIO DEL MATCHING (%s) ===\n", b.Symbol)
+	debugf("Estado inicial: %d compras, %d ventas\n", startBuys, startSells)
+	debugf("Tiempo de inicio: %s\n", startTime)
 
-			me.buyMutex.Lock()
-			prevBuyLen := me.BuyOrders.Len()
-			heap.Push(me.BuyOrders, bestBuy)
-			fmt.Printf("Devolviendo compra %d - Heap antes/después: %d/%d\n",
-				bestBuy.ID, prevBuyLen, me.BuyOrders.Len())
-			me.buyMutex.Unlock()
-
-			me.sellMutex.Lock()
-			prevSellLen := me.SellOrders.Len()
-			heap.Push(me.SellOrders, bestSell)
-			fmt.Printf("Devolviendo venta %d - Heap antes/después: %d/%d\n",
-				bestSell.ID, prevSellLen, me.SellOrders.Len())
-			me.sellMutex.Unlock()
+	for {
+		iterationCount++
+		debugf("\n--- Iteración %d ---\n", iterationCount)
+
+		// Sacar la mejor compra y la mejor venta en una sola sección
+		// crítica: con un solo mutex no hay ventana entre el pop de
+		// una y el pop de la otra en la que una orden recién llegada
+		// pueda colarse delante de las que ya estábamos comparando. Los
+		// debugf de abajo son deliberadamente posteriores al Unlock:
+		// son solo diagnóstico y no deben mantener el libro bloqueado
+		// para quien esté esperando en AddOrder.
+		b.mu.Lock()
+		if b.BuyOrders.Len() == 0 || b.SellOrders.Len() == 0 {
+			b.mu.Unlock()
+			debugf("No hay órdenes suficientes para emparejar\n")
 			break
 		}
+		bestBuy := heap.Pop(b.BuyOrders).(*Order)
+		bestSell := heap.Pop(b.SellOrders).(*Order)
+		matched := bestBuy.Price >= bestSell.Price
+		if !matched {
+			heap.Push(b.BuyOrders, bestBuy)
+			heap.Push(b.SellOrders, bestSell)
+		}
+		b.mu.Unlock()
 
-		fmt.Printf("\nEstado actual: %d compras, %d ventas\n",
-			me.BuyOrders.Len(), me.SellOrders.Len())
+		debugf("Comparando: Compra ID=%d Precio=%.2f Cantidad=%g vs Venta ID=%d Precio=%.2f Cantidad=%g\n",
+			bestBuy.ID, bestBuy.Price, bestBuy.Amount, bestSell.ID, bestSell.Price, bestSell.Amount)
 
-		// Verificar si quedan órdenes suficientes para continuar
-		if me.BuyOrders.Len() == 0 || me.SellOrders.Len() == 0 {
-			fmt.Printf("Terminando: No hay suficientes órdenes para continuar\n")
+		if !matched {
+			debugf("\nNo hay match: Precio compra %.2f < Precio venta %.2f\n",
+				bestBuy.Price, bestSell.Price)
 			break
 		}
+
+		tradeAmount := min(bestBuy.Amount, bestSell.Amount)
+		matchesFound++
+
+		debugf("\nMATCH #%d: Compra %d @ %.2f vs Venta %d @ %.2f, Cantidad=%g\n",
+			matchesFound, bestBuy.ID, bestBuy.Price, bestSell.ID, bestSell.Price, tradeAmount)
+
+		// Actualizar cantidades
+		bestBuy.Amount -= tradeAmount
+		bestSell.Amount -= tradeAmount
+
+		debugf("Cantidades después del trade - Compra: %g, Venta: %g\n",
+			bestBuy.Amount, bestSell.Amount)
+
+		b.executeTrade(bestBuy, bestSell, tradeAmount, time.Since(startTime))
+
+		// Solo reinsertar órdenes si tienen cantidad restante
+		if bestBuy.Amount > 0 {
+			b.mu.Lock()
+			heap.Push(b.BuyOrders, bestBuy)
+			b.mu.Unlock()
+			b.persistRestingOrder(bestBuy)
+		} else {
+			debugf("Orden de compra %d completada y eliminada\n", bestBuy.ID)
+			b.persistOrderRemoved(bestBuy)
+		}
+
+		if bestSell.Amount > 0 {
+			b.mu.Lock()
+			heap.Push(b.SellOrders, bestSell)
+			b.mu.Unlock()
+			b.persistRestingOrder(bestSell)
+		} else {
+			debugf("Orden de venta %d completada y eliminada\n", bestSell.ID)
+			b.persistOrderRemoved(bestSell)
+		}
 	}
 
 	duration := time.Since(startTime)
-	fmt.Printf("\n=== FIN DEL MATCHING ===\n")
-	fmt.Printf("Tiempo total: %s\n", duration)
-	fmt.Printf("Matches realizados: %d\n", matchesFound)
-	fmt.Printf("Iteraciones totales: %d\n", iterationCount)
-	fmt.Printf("Órdenes restantes: %d compras, %d ventas\n",
-		me.BuyOrders.Len(), me.SellOrders.Len())
+	endBuys, endSells := b.lens()
+	debugf("\n=== FIN DEL MATCHING (%s) ===\n", b.Symbol)
+	debugf("Tiempo total: %s\n", duration)
+	debugf("Matches realizados: %d\n", matchesFound)
+	debugf("Iteraciones totales: %d\n", iterationCount)
+	debugf("Órdenes restantes: %d compras, %d ventas\n", endBuys, endSells)
 }
 
-func min(a, b int) int {
+// lens devuelve, bajo b.mu, la longitud actual de ambos heaps. Leerlos
+// sin el lock competiría con los heap.Push/heap.Pop de addOrderInternal
+// y MatchOrders.
+func (b *Book) lens() (buys, sells int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.BuyOrders.Len(), b.SellOrders.Len()
+}
+
+func min(a, b float64) float64 {
 	if a < b {
 		return a
 	}
 	return b
 }
 
-func (me *MatchingEngine) executeTrade(buyOrder *Order, sellOrder *Order, amount int, duration time.Duration) {
-	//Lógica para ejecutar el trade.
-	fmt.Printf("Trade ejecutado. Compra: %d, Venta: %d, Cantidad: %d, Precio: %.2f, Duración: %s\n", buyOrder.ID, sellOrder.ID, amount, sellOrder.Price, duration)
-}
+// executeTrade registra un trade entre buyOrder y sellOrder por amount
+// unidades, al precio del maker: la orden que ya estaba descansando en
+// el libro (la que llegó primero según orderBefore), no siempre la de
+// venta. Cuando la orden agresiva es la de venta y cruza una compra
+// que descansaba a un precio más alto, el trade debe ejecutarse a ese
+// precio más alto, no al de la venta entrante; lo contrario corrompe
+// AverageCost/Realized/Volume en Ledger.applyFill y AverageFillPrice
+// en TWAPStatus.
+func (b *Book) executeTrade(buyOrder *Order, sellOrder *Order, amount float64, duration time.Duration) {
+	price := sellOrder.Price
+	if orderBefore(buyOrder, sellOrder) {
+		price = buyOrder.Price
+	}
 
-func AddOrderHandler(engine *MatchingEngine) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		order := new(Order)
-		if err := json.Unmarshal(c.Body(), order); err != nil {
-			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid order format"})
-		}
+	debugf("Trade ejecutado [%s]. Compra: %d, Venta: %d, Cantidad: %g, Precio: %.2f, Duración: %s\n",
+		b.Symbol, buyOrder.ID, sellOrder.ID, amount, price, duration)
 
-		engine.AddOrder(order)
-		return c.SendStatus(http.StatusCreated)
+	trade := Trade{
+		BuyOrderID:  buyOrder.ID,
+		SellOrderID: sellOrder.ID,
+		Symbol:      b.Symbol,
+		Price:       price,
+		Amount:      amount,
+		Ts:          time.Now(),
+	}
+
+	if b.ledger != nil {
+		b.ledger.RecordTrade(trade, buyOrder, sellOrder)
+	}
+
+	if b.tradeChannel == nil {
+		return
+	}
+
+	// Envío no bloqueante: el matching no debe frenarse si nadie está
+	// leyendo el canal de trades o si su buffer está lleno.
+	select {
+	case b.tradeChannel <- trade:
+	default:
+		fmt.Printf("Canal de trades lleno, se descarta el evento del trade %d/%d\n", buyOrder.ID, sellOrder.ID)
 	}
 }
 
-func (me *MatchingEngine) StartMatching() {
+// StartMatching lanza la gorutina que corre MatchOrders. En vez de
+// sondear cada 50ms, se queda dormida en matchTrigger: processOrders
+// la despierta solo cuando agrega una orden que podría cruzar el libro
+// opuesto (y restoreOrder, al rehidratar, tras cada orden restaurada),
+// así que no gasta CPU
+// de sobra estando el libro quieto ni le suma hasta 50ms de latencia a
+// cada match.
+func (b *Book) StartMatching() {
 	go func() {
-		for {
-			me.MatchOrders()
-			time.Sleep(50 * time.Millisecond) // Pausa para no consumir todos los recursos
+		for range b.matchTrigger {
+			b.MatchOrders()
 		}
 	}()
 }
 
-func (me *MatchingEngine) GetHighestBuyOrder() *Order {
-	me.buyMutex.Lock()
-	defer me.buyMutex.Unlock()
+// Snapshot devuelve una copia de todas las órdenes de ambos heaps,
+// tomada bajo b.mu, para que quien la lea no compita con los
+// heap.Push/heap.Pop de MatchOrders/addOrderInternal. Las órdenes se
+// clonan una a una, igual que GetHighestBuyOrder/GetHighestSellOrder,
+// para que nadie pueda mutar el heap real a través del resultado.
+func (b *Book) Snapshot() (buys []*Order, sells []*Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buys = make([]*Order, len(*b.BuyOrders))
+	for i, order := range *b.BuyOrders {
+		clone := *order
+		buys[i] = &clone
+	}
+
+	sells = make([]*Order, len(*b.SellOrders))
+	for i, order := range *b.SellOrders {
+		clone := *order
+		sells[i] = &clone
+	}
+
+	return buys, sells
+}
+
+func (b *Book) GetHighestBuyOrder() *Order {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.getHighestBuyOrderLocked()
+}
 
-	if me.BuyOrders.Len() > 0 {
+// getHighestBuyOrderLocked es como GetHighestBuyOrder pero asume que
+// quien la llama ya tiene b.mu tomado.
+func (b *Book) getHighestBuyOrderLocked() *Order {
+	if b.BuyOrders.Len() > 0 {
 		// Clonar la orden para evitar modificaciones externas
-		order := *(*me.BuyOrders)[0]
+		order := *(*b.BuyOrders)[0]
 		return &order
 	}
 	return nil
 }
 
-func (me *MatchingEngine) GetHighestSellOrder() *Order {
-	me.sellMutex.Lock()
-	defer me.sellMutex.Unlock()
+func (b *Book) GetHighestSellOrder() *Order {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.getHighestSellOrderLocked()
+}
 
-	if me.SellOrders.Len() > 0 {
+// getHighestSellOrderLocked es como GetHighestSellOrder pero asume que
+// quien la llama ya tiene b.mu tomado.
+func (b *Book) getHighestSellOrderLocked() *Order {
+	if b.SellOrders.Len() > 0 {
 		// Clonar la orden para evitar modificaciones externas
-		order := *(*me.SellOrders)[0]
+		order := *(*b.SellOrders)[0]
 		return &order
 	}
 	return nil
 }
 
+// MatchingEngine es el motor de emparejamiento. Mantiene un Book por
+// símbolo (instrumento), cada uno con su propio heap de compras,
+// heap de ventas y canal de órdenes, y valida cada orden entrante
+// contra el InstrumentRegistry antes de enrutarla a su libro.
+type MatchingEngine struct {
+	booksMu sync.RWMutex
+	books   map[string]*Book
+
+	registry *InstrumentRegistry
+
+	// tradeChannel recibe una copia de cada Trade ejecutado en
+	// cualquier Book del motor; lo consume el TWAPManager para llevar
+	// la cuenta de cuánto se ha llenado cada parent order.
+	tradeChannel chan Trade
+
+	// ledger lleva la posición y el P&L de cada cuenta a partir de los
+	// trades ejecutados en cualquier Book. NewMatchingEngine siempre lo
+	// crea, aunque store sea nil.
+	ledger *Ledger
+
+	// store persiste las órdenes abiertas y las posiciones para poder
+	// rehidratar el motor con Replay tras un reinicio. Puede ser nil.
+	store Store
+}
+
+// NewMatchingEngine crea un MatchingEngine vacío que creará un Book
+// por símbolo bajo demanda, a medida que lleguen órdenes para símbolos
+// nuevos. store puede ser nil si no se quiere persistencia; el ledger
+// se crea igual y lleva posiciones y P&L solo en memoria.
+func NewMatchingEngine(registry *InstrumentRegistry, store Store) *MatchingEngine {
+	return &MatchingEngine{
+		books:        make(map[string]*Book),
+		registry:     registry,
+		tradeChannel: make(chan Trade, 1024),
+		ledger:       NewLedger(store),
+		store:        store,
+	}
+}
+
+// getOrCreateBook devuelve el Book del símbolo, creándolo (y arrancando
+// sus gorutinas de procesamiento y matching) la primera vez que se le
+// pide.
+func (me *MatchingEngine) getOrCreateBook(symbol string) *Book {
+	me.booksMu.RLock()
+	book, ok := me.books[symbol]
+	me.booksMu.RUnlock()
+	if ok {
+		return book
+	}
+
+	me.booksMu.Lock()
+	defer me.booksMu.Unlock()
+
+	// Otra gorutina pudo haber creado el libro mientras esperábamos el lock.
+	if book, ok := me.books[symbol]; ok {
+		return book
+	}
+
+	book = NewBook(symbol, me.tradeChannel, me.ledger, me.store)
+	me.books[symbol] = book
+	return book
+}
+
+// Replay rehidrata el motor desde el store configurado: reconstruye
+// los heaps de cada libro con las órdenes que seguían abiertas y
+// restaura las posiciones de cada cuenta, para que un reinicio no
+// pierda estado. No hace nada si el motor no tiene store.
+func (me *MatchingEngine) Replay() error {
+	if me.store == nil {
+		return nil
+	}
+
+	orders, err := me.store.LoadOpenOrders()
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		me.getOrCreateBook(order.Symbol).restoreOrder(order)
+		bumpOrderSequence(order.Sequence)
+	}
+
+	positions, err := me.store.LoadPositions()
+	if err != nil {
+		return err
+	}
+	for _, pos := range positions {
+		me.ledger.restorePosition(pos)
+	}
+
+	return nil
+}
+
+// Ledger devuelve el ledger de posiciones y P&L del motor.
+func (me *MatchingEngine) Ledger() *Ledger {
+	return me.ledger
+}
+
+// getBook devuelve el Book del símbolo si ya existe, sin crearlo.
+func (me *MatchingEngine) getBook(symbol string) (*Book, bool) {
+	me.booksMu.RLock()
+	defer me.booksMu.RUnlock()
+	book, ok := me.books[symbol]
+	return book, ok
+}
+
+// orderSequence es el contador monótono del que sale cada
+// Order.Sequence, para desempatar de forma determinística órdenes que
+// comparten Timestamp. Replay lo adelanta con bumpOrderSequence hasta
+// el Sequence más alto entre las órdenes rehidratadas, porque de lo
+// contrario reiniciaría en cero tras un reinicio y podría repetir el
+// Sequence de una orden que ya estaba en el heap, rompiendo justo el
+// desempate determinístico para el que existe.
+var orderSequence uint64
+
+// bumpOrderSequence adelanta orderSequence hasta seq si seq es mayor
+// que el valor actual, sin retroceder nunca. Lo usa MatchingEngine.Replay
+// al rehidratar cada orden abierta.
+func bumpOrderSequence(seq uint64) {
+	for {
+		current := atomic.LoadUint64(&orderSequence)
+		if seq <= current {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&orderSequence, current, seq) {
+			return
+		}
+	}
+}
+
+// AddOrder valida la orden contra el InstrumentRegistry y, si pasa, la
+// estampa con un Timestamp y un Sequence y la enruta al Book de su
+// símbolo. Ambos campos fijan su posición en la cola FIFO de su nivel
+// de precio dentro del heap.
+func (me *MatchingEngine) AddOrder(order *Order) error {
+	if err := me.registry.Validate(order); err != nil {
+		return err
+	}
+	order.Timestamp = time.Now().UnixNano()
+	order.Sequence = atomic.AddUint64(&orderSequence, 1)
+	return me.getOrCreateBook(order.Symbol).AddOrder(order)
+}
+
+// GetHighestBuyOrder devuelve la mejor orden de compra del símbolo, o
+// nil si el símbolo no tiene libro todavía o no tiene compras.
+func (me *MatchingEngine) GetHighestBuyOrder(symbol string) *Order {
+	book, ok := me.getBook(symbol)
+	if !ok {
+		return nil
+	}
+	return book.GetHighestBuyOrder()
+}
+
+// GetHighestSellOrder devuelve la mejor orden de venta del símbolo, o
+// nil si el símbolo no tiene libro todavía o no tiene ventas.
+func (me *MatchingEngine) GetHighestSellOrder(symbol string) *Order {
+	book, ok := me.getBook(symbol)
+	if !ok {
+		return nil
+	}
+	return book.GetHighestSellOrder()
+}
+
+// twapChildOrderID genera un ID único para las órdenes hijas que el
+// TWAPExecutor agenda, separado del espacio de IDs que usan los
+// clientes del motor.
+var twapChildOrderID int64 = 1 << 30
+
+func nextTWAPChildOrderID() int {
+	return int(atomic.AddInt64(&twapChildOrderID, 1))
+}
+
+// TWAPOrder describe un parent order TWAP (Time-Weighted Average
+// Price): se reparte en órdenes hijas más pequeñas, espaciadas a lo
+// largo de Duration cada SliceInterval, hasta llenar TotalAmount.
+type TWAPOrder struct {
+	Symbol        string
+	Side          OrderType
+	TotalAmount   float64
+	PriceLimit    float64
+	Duration      time.Duration
+	SliceInterval time.Duration
+
+	// Aggressive determina el time-in-force de las órdenes hijas: si
+	// es true, cruzan el libro como IOC; si es false (el default),
+	// entran como POST_ONLY y solo descansan como maker.
+	Aggressive bool
+}
+
+// TWAPExecutor agenda y hace seguimiento de un TWAPOrder en curso.
+type TWAPExecutor struct {
+	ID string
+	TWAPOrder
+
+	mu             sync.Mutex
+	filled         float64
+	remaining      float64
+	filledNotional float64
+	nextSliceAt    time.Time
+	done           bool
+	childOrderIDs  map[int]bool
+
+	cancel     chan struct{}
+	cancelOnce sync.Once
+}
+
+// onTrade actualiza el progreso del executor si trade corresponde a
+// una de sus órdenes hijas.
+func (e *TWAPExecutor) onTrade(trade Trade) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.childOrderIDs[trade.BuyOrderID] && !e.childOrderIDs[trade.SellOrderID] {
+		return
+	}
+
+	e.filled += trade.Amount
+	e.remaining -= trade.Amount
+	e.filledNotional += trade.Price * trade.Amount
+	if e.remaining <= 0 {
+		e.done = true
+	}
+}
+
+// Cancel detiene el agendamiento de nuevas órdenes hijas. Es seguro
+// llamarla más de una vez o tras que el executor ya haya terminado.
+func (e *TWAPExecutor) Cancel() {
+	e.cancelOnce.Do(func() { close(e.cancel) })
+}
+
+// TWAPStatus es la representación pública del progreso de un TWAPOrder.
+type TWAPStatus struct {
+	ID               string
+	Symbol           string
+	Filled           float64
+	Remaining        float64
+	AverageFillPrice float64
+	NextSliceAt      time.Time
+	Done             bool
+}
+
+// Status toma una foto del progreso actual del executor.
+func (e *TWAPExecutor) Status() TWAPStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var avgPrice float64
+	if e.filled > 0 {
+		avgPrice = e.filledNotional / e.filled
+	}
+
+	return TWAPStatus{
+		ID:               e.ID,
+		Symbol:           e.Symbol,
+		Filled:           e.filled,
+		Remaining:        e.remaining,
+		AverageFillPrice: avgPrice,
+		NextSliceAt:      e.nextSliceAt,
+		Done:             e.done,
+	}
+}
+
+// TWAPManager crea y supervisa TWAPExecutors, y es el único
+// suscriptor del tradeChannel del motor: cada Trade que llega se
+// ofrece a todos los executors activos para que se queden con el suyo.
+type TWAPManager struct {
+	engine *MatchingEngine
+
+	mu        sync.Mutex
+	executors map[string]*TWAPExecutor
+	nextID    int64
+}
+
+// NewTWAPManager crea un TWAPManager y arranca la gorutina que
+// distribuye los trades del motor a los executors activos.
+func NewTWAPManager(engine *MatchingEngine) *TWAPManager {
+	m := &TWAPManager{
+		engine:    engine,
+		executors: make(map[string]*TWAPExecutor),
+	}
+	go m.dispatchTrades()
+	return m
+}
+
+func (m *TWAPManager) dispatchTrades() {
+	for trade := range m.engine.tradeChannel {
+		m.mu.Lock()
+		for _, exec := range m.executors {
+			exec.onTrade(trade)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Start agenda un nuevo TWAPOrder y devuelve el executor que lo está
+// ejecutando en segundo plano.
+func (m *TWAPManager) Start(order TWAPOrder) *TWAPExecutor {
+	m.mu.Lock()
+	m.nextID++
+	id := fmt.Sprintf("twap-%d", m.nextID)
+	m.mu.Unlock()
+
+	exec := &TWAPExecutor{
+		ID:            id,
+		TWAPOrder:     order,
+		remaining:     order.TotalAmount,
+		childOrderIDs: make(map[int]bool),
+		cancel:        make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	m.executors[id] = exec
+	m.mu.Unlock()
+
+	go m.run(exec)
+
+	return exec
+}
+
+// Get devuelve el executor con ese ID, si existe.
+func (m *TWAPManager) Get(id string) (*TWAPExecutor, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	exec, ok := m.executors[id]
+	return exec, ok
+}
+
+// Cancel detiene el executor con ese ID. Devuelve false si no existe.
+func (m *TWAPManager) Cancel(id string) bool {
+	exec, ok := m.Get(id)
+	if !ok {
+		return false
+	}
+	exec.Cancel()
+	return true
+}
+
+// run reparte exec.TotalAmount en órdenes hijas de tamaño aleatorizado
+// alrededor de TotalAmount/numSlices, agendándolas cada SliceInterval,
+// hasta llenar el total, agotar Duration o recibir una cancelación.
+func (m *TWAPManager) run(exec *TWAPExecutor) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.executors, exec.ID)
+		m.mu.Unlock()
+	}()
+
+	numSlices := int(exec.Duration / exec.SliceInterval)
+	if numSlices < 1 {
+		numSlices = 1
+	}
+	avgSlice := exec.TotalAmount / float64(numSlices)
+
+	tif := PostOnly
+	if exec.Aggressive {
+		tif = IOC
+	}
+
+	ticker := time.NewTicker(exec.SliceInterval)
+	deadline := time.NewTimer(exec.Duration)
+	defer ticker.Stop()
+	defer deadline.Stop()
+
+	exec.mu.Lock()
+	exec.nextSliceAt = time.Now().Add(exec.SliceInterval)
+	exec.mu.Unlock()
+
+	for {
+		select {
+		case <-exec.cancel:
+			exec.mu.Lock()
+			exec.done = true
+			exec.mu.Unlock()
+			return
+
+		case <-deadline.C:
+			exec.mu.Lock()
+			exec.done = true
+			exec.mu.Unlock()
+			return
+
+		case <-ticker.C:
+			exec.mu.Lock()
+			remaining := exec.remaining
+			exec.nextSliceAt = time.Now().Add(exec.SliceInterval)
+			exec.mu.Unlock()
+
+			if remaining <= 0 {
+				exec.mu.Lock()
+				exec.done = true
+				exec.mu.Unlock()
+				return
+			}
+
+			child := &Order{
+				ID:          nextTWAPChildOrderID(),
+				Symbol:      exec.Symbol,
+				Type:        exec.Side,
+				Price:       exec.PriceLimit,
+				Amount:      randomizeSliceAmount(avgSlice, remaining),
+				TimeInForce: tif,
+			}
+
+			exec.mu.Lock()
+			exec.childOrderIDs[child.ID] = true
+			exec.mu.Unlock()
+
+			if err := m.engine.AddOrder(child); err != nil {
+				fmt.Printf("Slice TWAP %s rechazada: %s\n", exec.ID, err)
+			}
+		}
+	}
+}
+
+// randomizeSliceAmount aleatoriza avg en un ±20% para reducir el
+// footprint de las órdenes hijas, sin exceder remaining ni bajar de un
+// mínimo positivo.
+func randomizeSliceAmount(avg, remaining float64) float64 {
+	jitter := avg * 0.2
+	amount := avg + (rand.Float64()*2-1)*jitter
+	if amount <= 0 {
+		amount = avg
+	}
+	if amount > remaining {
+		amount = remaining
+	}
+	return amount
+}
+
+func AddOrderHandler(engine *MatchingEngine) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		order := new(Order)
+		if err := json.Unmarshal(c.Body(), order); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid order format"})
+		}
+
+		if order.TimeInForce == "" {
+			order.TimeInForce = GTC
+		}
+
+		if err := engine.AddOrder(order); err != nil {
+			return c.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error":  "Order rejected",
+				"reason": err.Error(),
+			})
+		}
+		return c.SendStatus(http.StatusCreated)
+	}
+}
+
+func GetOrdersHandler(engine *MatchingEngine) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		symbol := c.Params("symbol")
+		book, ok := engine.getBook(symbol)
+		if !ok {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Unknown symbol"})
+		}
+		buys, sells := book.Snapshot()
+		return c.JSON(fiber.Map{
+			"buys":  buys,
+			"sells": sells,
+		})
+	}
+}
+
 func GetHighestBuyOrderHandler(engine *MatchingEngine) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		order := engine.GetHighestBuyOrder()
+		order := engine.GetHighestBuyOrder(c.Params("symbol"))
 		if order == nil {
 			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "No hay órdenes de compra disponibles"})
 		}
@@ -385,9 +1907,25 @@ func GetHighestBuyOrderHandler(engine *MatchingEngine) fiber.Handler {
 	}
 }
 
+func GetAccountPositionHandler(engine *MatchingEngine) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pos, ok := engine.Ledger().GetPosition(c.Params("id"), c.Params("symbol"))
+		if !ok {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Sin posición para esa cuenta y símbolo"})
+		}
+		return c.JSON(pos)
+	}
+}
+
+func GetAccountTradesHandler(engine *MatchingEngine) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(engine.Ledger().GetTrades(c.Params("id")))
+	}
+}
+
 func GetHighestSellOrderHandler(engine *MatchingEngine) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		order := engine.GetHighestSellOrder()
+		order := engine.GetHighestSellOrder(c.Params("symbol"))
 		if order == nil {
 			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "No hay órdenes de venta disponibles"})
 		}
@@ -395,31 +1933,98 @@ func GetHighestSellOrderHandler(engine *MatchingEngine) fiber.Handler {
 	}
 }
 
+// twapRequest es el cuerpo esperado por POST /orders/twap. Duration y
+// SliceInterval se aceptan en el formato de time.ParseDuration (p.ej.
+// "5m", "10s").
+type twapRequest struct {
+	Symbol        string    `json:"symbol"`
+	Side          OrderType `json:"side"`
+	TotalAmount   float64   `json:"totalAmount"`
+	PriceLimit    float64   `json:"priceLimit"`
+	Duration      string    `json:"duration"`
+	SliceInterval string    `json:"sliceInterval"`
+	Aggressive    bool      `json:"aggressive"`
+}
+
+func CreateTWAPHandler(manager *TWAPManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		req := new(twapRequest)
+		if err := json.Unmarshal(c.Body(), req); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid TWAP order format"})
+		}
+
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid duration: " + err.Error()})
+		}
+		sliceInterval, err := time.ParseDuration(req.SliceInterval)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid sliceInterval: " + err.Error()})
+		}
+
+		exec := manager.Start(TWAPOrder{
+			Symbol:        req.Symbol,
+			Side:          req.Side,
+			TotalAmount:   req.TotalAmount,
+			PriceLimit:    req.PriceLimit,
+			Duration:      duration,
+			SliceInterval: sliceInterval,
+			Aggressive:    req.Aggressive,
+		})
+
+		return c.Status(http.StatusCreated).JSON(exec.Status())
+	}
+}
+
+func GetTWAPStatusHandler(manager *TWAPManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		exec, ok := manager.Get(c.Params("id"))
+		if !ok {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Unknown TWAP order"})
+		}
+		return c.JSON(exec.Status())
+	}
+}
+
+func CancelTWAPHandler(manager *TWAPManager) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !manager.Cancel(c.Params("id")) {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{"error": "Unknown TWAP order"})
+		}
+		return c.SendStatus(http.StatusOK)
+	}
+}
+
 func main() {
 
 	app := fiber.New()
-	engine := &MatchingEngine{
-		BuyOrders:    &BuyHeap{},
-		SellOrders:   &SellHeap{},
-		orderChannel: make(chan *Order),
-	}
 
-	go engine.processOrders()
-	engine.StartMatching()
+	registry, err := LoadInstrumentRegistry("instruments.json")
+	if err != nil {
+		panic(err)
+	}
+	store := NewJSONFileStore(".")
+	engine := NewMatchingEngine(registry, store)
+	if err := engine.Replay(); err != nil {
+		panic(err)
+	}
+	twapManager := NewTWAPManager(engine)
 
 	app.Post("/orders", AddOrderHandler(engine))
 
-	app.Get("/orders", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"buys":  engine.BuyOrders,
-			"sells": engine.SellOrders,
-		})
-	})
+	app.Get("/orders/:symbol", GetOrdersHandler(engine))
 
 	//optener la orden de compra con el precio más alto
-	app.Get("/highest-buy-order", GetHighestBuyOrderHandler(engine))
+	app.Get("/highest-buy-order/:symbol", GetHighestBuyOrderHandler(engine))
+
+	app.Get("/highest-sell-order/:symbol", GetHighestSellOrderHandler(engine))
+
+	app.Get("/accounts/:id/position/:symbol", GetAccountPositionHandler(engine))
+	app.Get("/accounts/:id/trades", GetAccountTradesHandler(engine))
 
-	app.Get("/highest-sell-order", GetHighestSellOrderHandler(engine))
+	app.Post("/orders/twap", CreateTWAPHandler(twapManager))
+	app.Get("/orders/twap/:id", GetTWAPStatusHandler(twapManager))
+	app.Delete("/orders/twap/:id", CancelTWAPHandler(twapManager))
 
 	// Esperar un poco para que se procesen las órdenes
 	time.Sleep(1 * time.Second)
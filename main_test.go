@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPriceTimePriority somete N órdenes de compra al mismo precio y
+// comprueba que, al cruzarlas contra una venta agresiva que las llena
+// a todas, se ejecutan en el orden en que fueron enviadas (FIFO al
+// mismo nivel de precio), no en el orden interno del heap.
+func TestPriceTimePriority(t *testing.T) {
+	registry := NewInstrumentRegistry([]InstrumentConfig{
+		{Symbol: "BTCUSDT", TickSize: 0, LotSize: 0, MinNotional: 0},
+	})
+	engine := NewMatchingEngine(registry, nil)
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		order := &Order{ID: i + 1, Symbol: "BTCUSDT", Type: Buy, Price: 100, Amount: 1, TimeInForce: GTC}
+		if err := engine.AddOrder(order); err != nil {
+			t.Fatalf("AddOrder(buy %d) falló: %s", i+1, err)
+		}
+	}
+
+	sell := &Order{ID: n + 1, Symbol: "BTCUSDT", Type: Sell, Price: 100, Amount: n, TimeInForce: GTC}
+	if err := engine.AddOrder(sell); err != nil {
+		t.Fatalf("AddOrder(sell) falló: %s", err)
+	}
+
+	gotOrder := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case trade := <-engine.tradeChannel:
+			gotOrder = append(gotOrder, trade.BuyOrderID)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout esperando el trade %d/%d", i+1, n)
+		}
+	}
+
+	for i, buyID := range gotOrder {
+		wantID := i + 1
+		if buyID != wantID {
+			t.Errorf("trade %d: se llenó la compra %d, se esperaba la compra %d (orden de envío)", i, buyID, wantID)
+		}
+	}
+}
+
+// TestTradePricedAtMaker comprueba que, cuando una venta agresiva
+// cruza una compra que ya descansaba a un precio más alto, el trade se
+// registra al precio de la compra (el maker), no al de la venta
+// entrante.
+func TestTradePricedAtMaker(t *testing.T) {
+	registry := NewInstrumentRegistry([]InstrumentConfig{
+		{Symbol: "BTCUSDT", TickSize: 0, LotSize: 0, MinNotional: 0},
+	})
+	engine := NewMatchingEngine(registry, nil)
+
+	buy := &Order{ID: 1, Symbol: "BTCUSDT", Type: Buy, Price: 105, Amount: 1, TimeInForce: GTC}
+	if err := engine.AddOrder(buy); err != nil {
+		t.Fatalf("AddOrder(buy) falló: %s", err)
+	}
+
+	sell := &Order{ID: 2, Symbol: "BTCUSDT", Type: Sell, Price: 100, Amount: 1, TimeInForce: GTC}
+	if err := engine.AddOrder(sell); err != nil {
+		t.Fatalf("AddOrder(sell) falló: %s", err)
+	}
+
+	select {
+	case trade := <-engine.tradeChannel:
+		if trade.Price != 105 {
+			t.Errorf("trade.Price = %v, se esperaba 105 (precio de la compra, que era el maker)", trade.Price)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout esperando el trade")
+	}
+}
+
+// fakeReplayStore es un Store mínimo, solo para pruebas: LoadOpenOrders
+// devuelve las órdenes fijadas de antemano y el resto de operaciones
+// de persistencia son no-ops.
+type fakeReplayStore struct {
+	openOrders []*Order
+}
+
+func (s *fakeReplayStore) AppendTrade(Trade) error            { return nil }
+func (s *fakeReplayStore) SavePosition(Position) error        { return nil }
+func (s *fakeReplayStore) SaveOrder(*Order) error             { return nil }
+func (s *fakeReplayStore) RemoveOrder(string, int) error      { return nil }
+func (s *fakeReplayStore) LoadOpenOrders() ([]*Order, error)  { return s.openOrders, nil }
+func (s *fakeReplayStore) LoadPositions() ([]Position, error) { return nil, nil }
+
+// TestReplaySeedsOrderSequence comprueba que, tras rehidratar una orden
+// con un Sequence alto, las órdenes nuevas siguen numerándose por
+// encima de ella en vez de reiniciar desde cero: de lo contrario una
+// orden nueva podría compartir Sequence con una rehidratada y el
+// desempate determinístico de BuyHeap/SellHeap.Less dejaría de serlo.
+func TestReplaySeedsOrderSequence(t *testing.T) {
+	atomic.StoreUint64(&orderSequence, 0)
+
+	store := &fakeReplayStore{openOrders: []*Order{
+		{ID: 1, Symbol: "BTCUSDT", Type: Buy, Price: 100, Amount: 1, TimeInForce: GTC, Timestamp: 1, Sequence: 500},
+	}}
+	registry := NewInstrumentRegistry([]InstrumentConfig{
+		{Symbol: "BTCUSDT", TickSize: 0, LotSize: 0, MinNotional: 0},
+	})
+	engine := NewMatchingEngine(registry, store)
+	if err := engine.Replay(); err != nil {
+		t.Fatalf("Replay falló: %s", err)
+	}
+
+	order := &Order{ID: 2, Symbol: "BTCUSDT", Type: Sell, Price: 100, Amount: 1, TimeInForce: IOC}
+	if err := engine.AddOrder(order); err != nil {
+		t.Fatalf("AddOrder falló: %s", err)
+	}
+	if order.Sequence <= 500 {
+		t.Errorf("Sequence tras Replay = %d, se esperaba uno mayor al de la orden rehidratada (500)", order.Sequence)
+	}
+}
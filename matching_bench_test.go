@@ -0,0 +1,117 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// seedRestingBuys carga n compras GTC a basePrice directamente en el
+// heap de b, sin pasar por AddOrder, para no disparar matchTrigger
+// antes de que el benchmark quiera medir.
+func seedRestingBuys(b *Book, n int, basePrice float64) {
+	b.mu.Lock()
+	for i := 0; i < n; i++ {
+		heap.Push(b.BuyOrders, &Order{
+			ID:          i + 1,
+			Symbol:      b.Symbol,
+			Type:        Buy,
+			Price:       basePrice,
+			Amount:      1,
+			TimeInForce: GTC,
+			Timestamp:   int64(i),
+			Sequence:    uint64(i),
+		})
+	}
+	b.mu.Unlock()
+}
+
+// drainTrades consume want trades de ch, y reporta false si no llegan
+// todos antes de timeout.
+func drainTrades(ch chan Trade, want int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for i := 0; i < want; i++ {
+		select {
+		case <-ch:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// orderCounts son los tamaños de carga que estos benchmarks comparan,
+// pedidos explícitamente en el ticket: 1k, 10k y 100k órdenes.
+var orderCounts = []int{1_000, 10_000, 100_000}
+
+// BenchmarkMatchingEventDriven mide el camino actual: una venta que
+// cruza n compras en reposo se agrega directamente al heap y se
+// despierta a StartMatching con trigger(), sin esperar ningún tick.
+func BenchmarkMatchingEventDriven(b *testing.B) {
+	for _, n := range orderCounts {
+		b.Run(fmt.Sprintf("%d_ordenes", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tradeCh := make(chan Trade, n)
+				book := NewBook("BENCH", tradeCh, nil, nil)
+				seedRestingBuys(book, n, 100)
+				sell := &Order{ID: n + 1, Symbol: book.Symbol, Type: Sell, Price: 100, Amount: float64(n), TimeInForce: GTC}
+				b.StartTimer()
+
+				book.mu.Lock()
+				heap.Push(book.SellOrders, sell)
+				book.mu.Unlock()
+				book.trigger()
+
+				if !drainTrades(tradeCh, n, 10*time.Second) {
+					b.Fatalf("no se completaron los %d trades esperados", n)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMatchingPolled50ms mide el diseño anterior a este cambio:
+// una gorutina separada llama a MatchOrders cada 50ms en vez de
+// reaccionar a un trigger. El heap y el matching son los mismos que en
+// el benchmark de arriba; lo único que cambia es cómo se entera
+// StartMatching de que hay una venta nueva para cruzar.
+func BenchmarkMatchingPolled50ms(b *testing.B) {
+	for _, n := range orderCounts {
+		b.Run(fmt.Sprintf("%d_ordenes", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tradeCh := make(chan Trade, n)
+				book := NewBook("BENCH", tradeCh, nil, nil)
+				seedRestingBuys(book, n, 100)
+				sell := &Order{ID: n + 1, Symbol: book.Symbol, Type: Sell, Price: 100, Amount: float64(n), TimeInForce: GTC}
+
+				stop := make(chan struct{})
+				go func() {
+					ticker := time.NewTicker(50 * time.Millisecond)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-ticker.C:
+							book.MatchOrders()
+						case <-stop:
+							return
+						}
+					}
+				}()
+				b.StartTimer()
+
+				book.mu.Lock()
+				heap.Push(book.SellOrders, sell)
+				book.mu.Unlock()
+
+				ok := drainTrades(tradeCh, n, 10*time.Second)
+				close(stop)
+				if !ok {
+					b.Fatalf("no se completaron los %d trades esperados", n)
+				}
+			}
+		})
+	}
+}